@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/common/log"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// buildACMEManager builds the autocert.Manager used to obtain and renew the
+// exporter's TLS certificate via ACME/Let's Encrypt when
+// --web.tls.acme.enabled is set.
+func buildACMEManager() (*autocert.Manager, error) {
+	var hosts []string
+	if *tlsACMEHosts != "" {
+		hosts = strings.Split(*tlsACMEHosts, ",")
+	}
+
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(hosts...),
+		Cache:      autocert.DirCache(*tlsACMECacheDir),
+		Email:      *tlsACMEEmail,
+		Client:     &acme.Client{DirectoryURL: *tlsACMEDirectoryURL},
+	}
+
+	return manager, nil
+}
+
+// serveACMEHTTPChallenge runs the ACME HTTP-01 challenge handler on
+// --web.tls.acme.http-address. It must be reachable on port 80 (or have
+// port 80 forwarded to it) for the ACME server to validate domain
+// ownership.
+func serveACMEHTTPChallenge(manager *autocert.Manager) {
+	go func() {
+		log.Fatal(http.ListenAndServe(*tlsACMEHTTPAddress, manager.HTTPHandler(nil)))
+	}()
+}
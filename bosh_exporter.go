@@ -1,30 +1,35 @@
 package main
 
 import (
-	"errors"
-	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 
 	"github.com/cloudfoundry/bosh-cli/director"
-	"github.com/cloudfoundry/bosh-cli/uaa"
 	"github.com/cloudfoundry/bosh-utils/logger"
 	"github.com/cloudfoundry/bosh-utils/system"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/log"
 	"github.com/prometheus/common/version"
+	"golang.org/x/crypto/acme"
 	"gopkg.in/alecthomas/kingpin.v2"
 
 	"github.com/bosh-prometheus/bosh_exporter/collectors"
 	"github.com/bosh-prometheus/bosh_exporter/deployments"
 	"github.com/bosh-prometheus/bosh_exporter/filters"
+	"github.com/bosh-prometheus/bosh_exporter/serviceDiscovery"
 )
 
 var (
+	configFile = kingpin.Flag(
+		"config.file", "Path to a config file listing multiple BOSH Directors to scrape through /probe ($BOSH_EXPORTER_CONFIG_FILE)",
+	).Envar("BOSH_EXPORTER_CONFIG_FILE").String()
+
 	boshURL = kingpin.Flag(
 		"bosh.url", "BOSH URL ($BOSH_EXPORTER_BOSH_URL)",
-	).Envar("BOSH_EXPORTER_BOSH_URL").Required().String()
+	).Envar("BOSH_EXPORTER_BOSH_URL").String()
 
 	boshUsername = kingpin.Flag(
 		"bosh.username", "BOSH Username ($BOSH_EXPORTER_BOSH_USERNAME)",
@@ -42,13 +47,21 @@ var (
 		"bosh.uaa.client-secret", "BOSH UAA Client Secret ($BOSH_EXPORTER_BOSH_UAA_CLIENT_SECRET)",
 	).Envar("BOSH_EXPORTER_BOSH_UAA_CLIENT_SECRET").String()
 
+	boshUAATokenCacheFile = kingpin.Flag(
+		"bosh.uaa.token-cache-file", "Path to a file used to persist the UAA refresh token across restarts ($BOSH_EXPORTER_UAA_TOKEN_CACHE_FILE)",
+	).Envar("BOSH_EXPORTER_UAA_TOKEN_CACHE_FILE").String()
+
+	boshUAATokenCacheKey = kingpin.Flag(
+		"bosh.uaa.token-cache-key", "Passphrase used to encrypt the UAA token cache file ($BOSH_EXPORTER_UAA_TOKEN_CACHE_KEY)",
+	).Envar("BOSH_EXPORTER_UAA_TOKEN_CACHE_KEY").String()
+
 	boshLogLevel = kingpin.Flag(
 		"bosh.log-level", "BOSH Log Level ($BOSH_EXPORTER_BOSH_LOG_LEVEL)",
 	).Envar("BOSH_EXPORTER_BOSH_LOG_LEVEL").Default("ERROR").String()
 
 	boshCACertFile = kingpin.Flag(
 		"bosh.ca-cert-file", "BOSH CA Certificate file ($BOSH_EXPORTER_BOSH_CA_CERT_FILE)",
-	).Envar("BOSH_EXPORTER_BOSH_CA_CERT_FILE").Required().ExistingFile()
+	).Envar("BOSH_EXPORTER_BOSH_CA_CERT_FILE").String()
 
 	filterDeployments = kingpin.Flag(
 		"filter.deployments", "Comma separated deployments to filter ($BOSH_EXPORTER_FILTER_DEPLOYMENTS)",
@@ -68,11 +81,11 @@ var (
 
 	metricsEnvironment = kingpin.Flag(
 		"metrics.environment", "Environment label to be attached to metrics ($BOSH_EXPORTER_METRICS_ENVIRONMENT)",
-	).Envar("BOSH_EXPORTER_METRICS_ENVIRONMENT").Required().String()
+	).Envar("BOSH_EXPORTER_METRICS_ENVIRONMENT").String()
 
-	sdFilename = kingpin.Flag(
-		"sd.filename", "Full path to the Service Discovery output file ($BOSH_EXPORTER_SD_FILENAME)",
-	).Envar("BOSH_EXPORTER_SD_FILENAME").Default("bosh_target_groups.json").String()
+	sdOutputs = kingpin.Flag(
+		"sd.output", "Service Discovery output, repeatable (file:<path>[.json|.yaml], http, consul://<address>, k8s://<namespace>/<name>). Defaults to file:bosh_target_groups.json ($BOSH_EXPORTER_SD_OUTPUT)",
+	).Envar("BOSH_EXPORTER_SD_OUTPUT").Strings()
 
 	sdProcessesRegexp = kingpin.Flag(
 		"sd.processes_regexp", "Regexp to filter Service Discovery processes names ($BOSH_EXPORTER_SD_PROCESSES_REGEXP)",
@@ -101,6 +114,30 @@ var (
 	tlsKeyFile = kingpin.Flag(
 		"web.tls.key_file", "Path to a file that contains the TLS private key (PEM format) ($BOSH_EXPORTER_WEB_TLS_KEYFILE)",
 	).Envar("BOSH_EXPORTER_WEB_TLS_KEYFILE").ExistingFile()
+
+	tlsACMEEnabled = kingpin.Flag(
+		"web.tls.acme.enabled", "Obtain and renew the TLS certificate automatically via ACME/Let's Encrypt ($BOSH_EXPORTER_WEB_TLS_ACME_ENABLED)",
+	).Envar("BOSH_EXPORTER_WEB_TLS_ACME_ENABLED").Default("false").Bool()
+
+	tlsACMEHosts = kingpin.Flag(
+		"web.tls.acme.hosts", "Comma separated list of hostnames the exporter will answer for ($BOSH_EXPORTER_WEB_TLS_ACME_HOSTS)",
+	).Envar("BOSH_EXPORTER_WEB_TLS_ACME_HOSTS").String()
+
+	tlsACMECacheDir = kingpin.Flag(
+		"web.tls.acme.cache-dir", "Directory used to cache ACME certificates and the account key ($BOSH_EXPORTER_WEB_TLS_ACME_CACHE_DIR)",
+	).Envar("BOSH_EXPORTER_WEB_TLS_ACME_CACHE_DIR").Default(".").String()
+
+	tlsACMEEmail = kingpin.Flag(
+		"web.tls.acme.email", "Contact email address used when registering with the ACME server ($BOSH_EXPORTER_WEB_TLS_ACME_EMAIL)",
+	).Envar("BOSH_EXPORTER_WEB_TLS_ACME_EMAIL").String()
+
+	tlsACMEDirectoryURL = kingpin.Flag(
+		"web.tls.acme.directory-url", "ACME directory URL ($BOSH_EXPORTER_WEB_TLS_ACME_DIRECTORY_URL)",
+	).Envar("BOSH_EXPORTER_WEB_TLS_ACME_DIRECTORY_URL").Default(acme.LetsEncryptURL).String()
+
+	tlsACMEHTTPAddress = kingpin.Flag(
+		"web.tls.acme.http-address", "Address the ACME HTTP-01 challenge handler listens on ($BOSH_EXPORTER_WEB_TLS_ACME_HTTP_ADDRESS)",
+	).Envar("BOSH_EXPORTER_WEB_TLS_ACME_HTTP_ADDRESS").Default(":80").String()
 )
 
 func init() {
@@ -126,17 +163,23 @@ func (h *basicAuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func prometheusHandler() http.Handler {
-	handler := prometheus.Handler()
+	return withBasicAuth(prometheus.Handler().ServeHTTP)
+}
 
-	if *authUsername != "" && *authPassword != "" {
-		handler = &basicAuthHandler{
-			handler:  prometheus.Handler().ServeHTTP,
-			username: *authUsername,
-			password: *authPassword,
-		}
+// withBasicAuth wraps handler with the same --web.auth.username/password
+// check as prometheusHandler, so that /probe and /sd -- not just
+// --web.telemetry-path -- honor the configured basic auth. The "/" landing
+// page and the ACME HTTP-01 challenge handler are served without it.
+func withBasicAuth(handler http.HandlerFunc) http.Handler {
+	if *authUsername == "" || *authPassword == "" {
+		return handler
 	}
 
-	return handler
+	return &basicAuthHandler{
+		handler:  handler,
+		username: *authUsername,
+		password: *authPassword,
+	}
 }
 
 func readCACert(CACertFile string, logger logger.Logger) (string, error) {
@@ -159,106 +202,29 @@ func readCACert(CACertFile string, logger logger.Logger) (string, error) {
 	return "", nil
 }
 
+// buildBOSHClient builds a director.Director from the legacy command-line
+// flags. It is a thin wrapper around buildBOSHClientFromConfig so that the
+// single-target flag-driven mode and the multi-target config-file-driven
+// `/probe` mode share exactly one BOSH authentication code path.
 func buildBOSHClient() (director.Director, error) {
-	logLevel, err := logger.Levelify(*boshLogLevel)
-	if err != nil {
-		return nil, err
-	}
-
-	logger := logger.NewLogger(logLevel)
-
-	directorConfig, err := director.NewConfigFromURL(*boshURL)
-	if err != nil {
-		return nil, err
-	}
-
-	boshCACert, err := readCACert(*boshCACertFile, logger)
-	if err != nil {
-		return nil, err
-	}
-	directorConfig.CACert = boshCACert
-
-	anonymousDirector, err := director.NewFactory(logger).New(directorConfig, nil, nil)
-	if err != nil {
-		return nil, err
-	}
-
-	boshInfo, err := anonymousDirector.Info()
-	if err != nil {
-		return nil, err
-	}
-
-	if boshInfo.Auth.Type != "uaa" {
-		directorConfig.Client = *boshUsername
-		directorConfig.ClientSecret = *boshPassword
-	} else {
-		uaaURL := boshInfo.Auth.Options["url"]
-		uaaURLStr, ok := uaaURL.(string)
-		if !ok {
-			return nil, errors.New(fmt.Sprintf("Expected UAA URL '%s' to be a string", uaaURL))
-		}
-
-		uaaConfig, err := uaa.NewConfigFromURL(uaaURLStr)
-		if err != nil {
-			return nil, err
-		}
-
-		uaaConfig.CACert = boshCACert
-
-		if *boshUAAClientID != "" && *boshUAAClientSecret != "" {
-			uaaConfig.Client = *boshUAAClientID
-			uaaConfig.ClientSecret = *boshUAAClientSecret
-		} else {
-			uaaConfig.Client = "bosh_cli"
-		}
-
-		uaaFactory := uaa.NewFactory(logger)
-		uaaClient, err := uaaFactory.New(uaaConfig)
-		if err != nil {
-			return nil, err
-		}
-
-		if *boshUAAClientID != "" && *boshUAAClientSecret != "" {
-			directorConfig.TokenFunc = uaa.NewClientTokenSession(uaaClient).TokenFunc
-		} else {
-			answers := []uaa.PromptAnswer{
-				uaa.PromptAnswer{
-					Key:   "username",
-					Value: *boshUsername,
-				},
-				uaa.PromptAnswer{
-					Key:   "password",
-					Value: *boshPassword,
-				},
-			}
-			accessToken, err := uaaClient.OwnerPasswordCredentialsGrant(answers)
-			if err != nil {
-				return nil, err
-			}
-
-			origToken := uaaClient.NewStaleAccessToken(accessToken.RefreshToken().Value())
-			directorConfig.TokenFunc = uaa.NewAccessTokenSession(origToken).TokenFunc
-		}
-	}
-
-	boshFactory := director.NewFactory(logger)
-	boshClient, err := boshFactory.New(directorConfig, director.NewNoopTaskReporter(), director.NewNoopFileReporter())
-	if err != nil {
-		return nil, err
-	}
-
-	return boshClient, nil
+	return buildBOSHClientFromConfig(TargetConfig{
+		Name:                  "default",
+		BoshURL:               *boshURL,
+		BoshUsername:          *boshUsername,
+		BoshPassword:          *boshPassword,
+		BoshUAAClientID:       *boshUAAClientID,
+		BoshUAAClientSecret:   *boshUAAClientSecret,
+		BoshUAATokenCacheFile: *boshUAATokenCacheFile,
+		BoshUAATokenCacheKey:  *boshUAATokenCacheKey,
+		BoshLogLevel:          *boshLogLevel,
+		BoshCACertFile:        *boshCACertFile,
+	}, nil)
 }
 
-func main() {
-	log.AddFlags(kingpin.CommandLine)
-	kingpin.Version(version.Print("fbosh_exporter"))
-	kingpin.HelpFlag.Short('h')
-	kingpin.Parse()
-
-	log.Infoln("Starting bosh_exporter", version.Info())
-	log.Infoln("Build context", version.BuildContext())
-
+// runSingleTarget wires up the legacy mode, where the exporter scrapes the
+// one BOSH Director described by the command-line flags and serves its
+// metrics directly on --web.telemetry-path.
+func runSingleTarget() []serviceDiscovery.Writer {
 	boshClient, err := buildBOSHClient()
 	if err != nil {
 		log.Errorf("Error creating BOSH Client: %s", err.Error())
@@ -305,12 +271,24 @@ func main() {
 		os.Exit(1)
 	}
 
+	sdOutputsRaw := *sdOutputs
+	if len(sdOutputsRaw) == 0 {
+		sdOutputsRaw = defaultSDOutputs
+	}
+
+	sdWriters, err := serviceDiscovery.ParseOutputs(sdOutputsRaw, *metricsNamespace)
+	if err != nil {
+		log.Errorf("Error creating Service Discovery outputs: %s", err.Error())
+		os.Exit(1)
+	}
+	mountSDHTTPWriters(sdWriters)
+
 	boshCollector := collectors.NewBoshCollector(
 		*metricsNamespace,
 		*metricsEnvironment,
 		boshInfo.Name,
 		boshInfo.UUID,
-		*sdFilename,
+		sdWriters,
 		deploymentsFetcher,
 		collectorsFilter,
 		azsFilter,
@@ -319,6 +297,84 @@ func main() {
 	prometheus.MustRegister(boshCollector)
 
 	http.Handle(*metricsPath, prometheusHandler())
+
+	return sdWriters
+}
+
+// runMultiTarget wires up /probe for config-file mode, where a single
+// exporter process serves any number of BOSH Directors listed in cfg.
+// --web.telemetry-path keeps reporting the exporter's own process metrics.
+// The returned sdWriterCache lets main() close every target's Service
+// Discovery outputs on shutdown.
+func runMultiTarget(cfg *Config) *sdWriterCache {
+	cache, err := newDirectorCache()
+	if err != nil {
+		log.Errorf("Error creating Director cache: %s", err.Error())
+		os.Exit(1)
+	}
+
+	writers, err := newSDWriterCache()
+	if err != nil {
+		log.Errorf("Error creating Service Discovery writer cache: %s", err.Error())
+		os.Exit(1)
+	}
+
+	log.Infof("Serving %d BOSH Director(s) through /probe", len(cfg.Targets))
+
+	http.Handle(*metricsPath, prometheusHandler())
+	http.Handle("/probe", withBasicAuth(probeHandler(cfg, cache, writers)))
+	http.Handle("/sd", withBasicAuth(sdHandler(cfg, writers)))
+
+	return writers
+}
+
+// closeSDOutputsOnSignal closes every configured Service Discovery output
+// (deregistering Consul services, deleting Kubernetes EndpointSlices, ...)
+// when the exporter receives SIGINT/SIGTERM, then exits.
+func closeSDOutputsOnSignal(closeSDOutputs func() error) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		sig := <-sigCh
+		log.Infof("Received signal %s, closing Service Discovery outputs", sig)
+		if err := closeSDOutputs(); err != nil {
+			log.Errorf("Error closing Service Discovery outputs: %s", err.Error())
+		}
+		os.Exit(0)
+	}()
+}
+
+func main() {
+	log.AddFlags(kingpin.CommandLine)
+	kingpin.Version(version.Print("fbosh_exporter"))
+	kingpin.HelpFlag.Short('h')
+	kingpin.Parse()
+
+	log.Infoln("Starting bosh_exporter", version.Info())
+	log.Infoln("Build context", version.BuildContext())
+
+	if *configFile != "" {
+		cfg, err := LoadConfig(*configFile)
+		if err != nil {
+			log.Errorf("Error loading config file `%s`: %s", *configFile, err.Error())
+			os.Exit(1)
+		}
+		writers := runMultiTarget(cfg)
+		closeSDOutputsOnSignal(func() error {
+			return serviceDiscovery.CloseAll(writers.All())
+		})
+	} else {
+		if *boshURL == "" {
+			log.Errorf("Either --config.file or --bosh.url must be set")
+			os.Exit(1)
+		}
+		sdWriters := runSingleTarget()
+		closeSDOutputsOnSignal(func() error {
+			return serviceDiscovery.CloseAll(sdWriters)
+		})
+	}
+
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(`<html>
              <head><title>BOSH Exporter</title></head>
@@ -329,10 +385,35 @@ func main() {
              </html>`))
 	})
 
-	if *tlsCertFile != "" && *tlsKeyFile != "" {
+	if *tlsCertFile != "" && *tlsKeyFile != "" && *tlsACMEEnabled {
+		log.Errorf("--web.tls.cert_file/--web.tls.key_file and --web.tls.acme.enabled are mutually exclusive")
+		os.Exit(1)
+	}
+
+	if *tlsACMEEnabled && *tlsACMEHosts == "" {
+		log.Errorf("--web.tls.acme.hosts must be set when --web.tls.acme.enabled is true")
+		os.Exit(1)
+	}
+
+	switch {
+	case *tlsACMEEnabled:
+		manager, err := buildACMEManager()
+		if err != nil {
+			log.Errorf("Error creating ACME manager: %s", err.Error())
+			os.Exit(1)
+		}
+		serveACMEHTTPChallenge(manager)
+
+		server := &http.Server{
+			Addr:      *listenAddress,
+			TLSConfig: manager.TLSConfig(),
+		}
+		log.Infoln("Listening TLS (ACME) on", *listenAddress)
+		log.Fatal(server.ListenAndServeTLS("", ""))
+	case *tlsCertFile != "" && *tlsKeyFile != "":
 		log.Infoln("Listening TLS on", *listenAddress)
 		log.Fatal(http.ListenAndServeTLS(*listenAddress, *tlsCertFile, *tlsKeyFile, nil))
-	} else {
+	default:
 		log.Infoln("Listening on", *listenAddress)
 		log.Fatal(http.ListenAndServe(*listenAddress, nil))
 	}
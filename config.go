@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"gopkg.in/yaml.v2"
+)
+
+// TargetConfig describes a single BOSH Director to be scraped when the
+// exporter is running in `--config.file` (multi-target) mode. Each field
+// mirrors one of the legacy command-line flags so that a director can be
+// configured exactly as it would be on the command line.
+type TargetConfig struct {
+	Name                string `yaml:"name"`
+	BoshURL             string `yaml:"bosh_url"`
+	BoshUsername        string `yaml:"bosh_username"`
+	BoshPassword        string `yaml:"bosh_password"`
+	BoshUAAClientID     string `yaml:"bosh_uaa_client_id"`
+	BoshUAAClientSecret string `yaml:"bosh_uaa_client_secret"`
+
+	BoshUAATokenCacheFile string `yaml:"bosh_uaa_token_cache_file"`
+	BoshUAATokenCacheKey  string `yaml:"bosh_uaa_token_cache_key"`
+
+	BoshLogLevel   string `yaml:"bosh_log_level"`
+	BoshCACertFile string `yaml:"bosh_ca_cert_file"`
+
+	FilterDeployments string `yaml:"filter_deployments"`
+	FilterAZs         string `yaml:"filter_azs"`
+	FilterCollectors  string `yaml:"filter_collectors"`
+
+	MetricsEnvironment string `yaml:"metrics_environment"`
+
+	SDOutputs         []string `yaml:"sd_outputs"`
+	SDProcessesRegexp string   `yaml:"sd_processes_regexp"`
+}
+
+// Config is the top level structure of the `--config.file` YAML document. It
+// lists every BOSH Director the exporter is able to scrape through the
+// `/probe` handler.
+type Config struct {
+	Targets []TargetConfig `yaml:"targets"`
+}
+
+// LoadConfig reads and parses the config file at path.
+func LoadConfig(path string) (*Config, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &Config{}
+	if err := yaml.Unmarshal(content, cfg); err != nil {
+		return nil, err
+	}
+
+	if len(cfg.Targets) == 0 {
+		return nil, fmt.Errorf("config file `%s` does not define any targets", path)
+	}
+
+	seen := make(map[string]bool, len(cfg.Targets))
+	for _, target := range cfg.Targets {
+		if target.Name == "" {
+			return nil, fmt.Errorf("target is missing a `name`")
+		}
+		if target.BoshURL == "" {
+			return nil, fmt.Errorf("target `%s` is missing a `bosh_url`", target.Name)
+		}
+		if seen[target.Name] {
+			return nil, fmt.Errorf("duplicate target name `%s`", target.Name)
+		}
+		seen[target.Name] = true
+	}
+
+	return cfg, nil
+}
+
+// Target looks up a TargetConfig by name.
+func (c *Config) Target(name string) (TargetConfig, bool) {
+	for _, target := range c.Targets {
+		if target.Name == name {
+			return target, true
+		}
+	}
+
+	return TargetConfig{}, false
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry/bosh-cli/director"
+	"github.com/cloudfoundry/bosh-cli/uaa"
+	"github.com/cloudfoundry/bosh-utils/logger"
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/log"
+	"golang.org/x/sync/singleflight"
+
+	"github.com/bosh-prometheus/bosh_exporter/collectors"
+	"github.com/bosh-prometheus/bosh_exporter/deployments"
+	"github.com/bosh-prometheus/bosh_exporter/filters"
+)
+
+// directorCacheSize bounds the number of director.Director clients the
+// `/probe` handler keeps warm across requests, one per distinct target.
+const directorCacheSize = 32
+
+// directorCacheEntry pairs a cached director.Director with the stop channel
+// of its startTokenCacheRefresher goroutine (nil if it has none), so the
+// goroutine can be torn down when the entry is evicted.
+type directorCacheEntry struct {
+	director director.Director
+	stop     chan struct{}
+}
+
+// directorCache caches director.Director clients built from a TargetConfig so
+// that a `/probe` scrape does not have to re-authenticate against UAA (or
+// re-fetch the anonymous Info()) on every request. build deduplicates
+// concurrent first-time builds for the same target so that two simultaneous
+// `/probe` requests cannot each run their own UAA login and goroutine. The
+// eviction callback stops a target's token refresher goroutine as soon as
+// its entry leaves the cache, so LRU churn cannot accumulate them forever.
+type directorCache struct {
+	cache *lru.Cache
+	build singleflight.Group
+}
+
+func newDirectorCache() (*directorCache, error) {
+	cache, err := lru.NewWithEvict(directorCacheSize, func(key interface{}, value interface{}) {
+		if entry, ok := value.(*directorCacheEntry); ok && entry.stop != nil {
+			close(entry.stop)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &directorCache{cache: cache}, nil
+}
+
+func (c *directorCache) Get(target TargetConfig) (director.Director, error) {
+	if cached, ok := c.cache.Get(target.Name); ok {
+		return cached.(*directorCacheEntry).director, nil
+	}
+
+	entry, err, _ := c.build.Do(target.Name, func() (interface{}, error) {
+		if cached, ok := c.cache.Get(target.Name); ok {
+			return cached.(*directorCacheEntry), nil
+		}
+
+		stop := make(chan struct{})
+		boshClient, err := buildBOSHClientFromConfig(target, stop)
+		if err != nil {
+			close(stop)
+			return nil, err
+		}
+
+		entry := &directorCacheEntry{director: boshClient, stop: stop}
+		c.cache.Add(target.Name, entry)
+
+		return entry, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return entry.(*directorCacheEntry).director, nil
+}
+
+// buildBOSHClientFromConfig builds a director.Director for a single
+// TargetConfig. It is the config-file-driven counterpart of
+// buildBOSHClient, which builds one from the legacy command-line flags.
+// stop, when non-nil, is closed to stop the UAA token refresher goroutine
+// buildBOSHClientFromConfig may start; pass nil when the caller has no
+// cache eviction to tie it to.
+func buildBOSHClientFromConfig(target TargetConfig, stop <-chan struct{}) (director.Director, error) {
+	logLevelName := target.BoshLogLevel
+	if logLevelName == "" {
+		logLevelName = "ERROR"
+	}
+
+	logLevel, err := logger.Levelify(logLevelName)
+	if err != nil {
+		return nil, err
+	}
+
+	boshLogger := logger.NewLogger(logLevel)
+
+	directorConfig, err := director.NewConfigFromURL(target.BoshURL)
+	if err != nil {
+		return nil, err
+	}
+
+	boshCACert, err := readCACert(target.BoshCACertFile, boshLogger)
+	if err != nil {
+		return nil, err
+	}
+	directorConfig.CACert = boshCACert
+
+	anonymousDirector, err := director.NewFactory(boshLogger).New(directorConfig, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	boshInfo, err := anonymousDirector.Info()
+	if err != nil {
+		return nil, err
+	}
+
+	if boshInfo.Auth.Type != "uaa" {
+		directorConfig.Client = target.BoshUsername
+		directorConfig.ClientSecret = target.BoshPassword
+	} else {
+		uaaURL := boshInfo.Auth.Options["url"]
+		uaaURLStr, ok := uaaURL.(string)
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("Expected UAA URL '%s' to be a string", uaaURL))
+		}
+
+		uaaConfig, err := uaa.NewConfigFromURL(uaaURLStr)
+		if err != nil {
+			return nil, err
+		}
+
+		uaaConfig.CACert = boshCACert
+
+		if target.BoshUAAClientID != "" && target.BoshUAAClientSecret != "" {
+			uaaConfig.Client = target.BoshUAAClientID
+			uaaConfig.ClientSecret = target.BoshUAAClientSecret
+		} else {
+			uaaConfig.Client = "bosh_cli"
+		}
+
+		uaaFactory := uaa.NewFactory(boshLogger)
+		uaaClient, err := uaaFactory.New(uaaConfig)
+		if err != nil {
+			return nil, err
+		}
+
+		if target.BoshUAAClientID != "" && target.BoshUAAClientSecret != "" {
+			directorConfig.TokenFunc = uaa.NewClientTokenSession(uaaClient).TokenFunc
+		} else {
+			origToken, err := obtainUAAAccessToken(uaaClient, target)
+			if err != nil {
+				return nil, err
+			}
+
+			session := uaa.NewAccessTokenSession(origToken)
+			directorConfig.TokenFunc = session.TokenFunc
+
+			if target.BoshUAATokenCacheFile != "" {
+				startTokenCacheRefresher(target, origToken, session.TokenFunc, stop)
+			}
+		}
+	}
+
+	boshFactory := director.NewFactory(boshLogger)
+	boshClient, err := boshFactory.New(directorConfig, director.NewNoopTaskReporter(), director.NewNoopFileReporter())
+	if err != nil {
+		return nil, err
+	}
+
+	return boshClient, nil
+}
+
+// obtainUAAAccessToken returns a UAA access token for target's password
+// credentials, reusing a cached refresh token from
+// target.BoshUAATokenCacheFile when one is present and still valid, and
+// only falling back to an OwnerPasswordCredentialsGrant (which generates a
+// UAA login event) when there is no cached token or the refresh fails.
+func obtainUAAAccessToken(uaaClient uaa.UAA, target TargetConfig) (uaa.AccessToken, error) {
+	if target.BoshUAATokenCacheFile != "" {
+		cachedRefreshToken, err := loadCachedRefreshToken(target.BoshUAATokenCacheFile, target.BoshUAATokenCacheKey)
+		if err != nil {
+			log.Errorf("Error reading UAA token cache file `%s`: %s", target.BoshUAATokenCacheFile, err.Error())
+		}
+
+		if cachedRefreshToken != "" {
+			origToken := uaaClient.NewStaleAccessToken(cachedRefreshToken)
+			if _, err := uaa.NewAccessTokenSession(origToken).TokenFunc(true); err == nil {
+				return origToken, nil
+			}
+			log.Errorf("Cached UAA refresh token for target `%s` is no longer valid, falling back to password grant", target.Name)
+		}
+	}
+
+	answers := []uaa.PromptAnswer{
+		uaa.PromptAnswer{
+			Key:   "username",
+			Value: target.BoshUsername,
+		},
+		uaa.PromptAnswer{
+			Key:   "password",
+			Value: target.BoshPassword,
+		},
+	}
+	accessToken, err := uaaClient.OwnerPasswordCredentialsGrant(answers)
+	if err != nil {
+		return nil, err
+	}
+
+	refreshToken := accessToken.RefreshToken().Value()
+	origToken := uaaClient.NewStaleAccessToken(refreshToken)
+
+	if target.BoshUAATokenCacheFile != "" {
+		if err := saveCachedRefreshToken(target.BoshUAATokenCacheFile, target.BoshUAATokenCacheKey, refreshToken); err != nil {
+			log.Errorf("Error writing UAA token cache file `%s`: %s", target.BoshUAATokenCacheFile, err.Error())
+		}
+	}
+
+	return origToken, nil
+}
+
+// startTokenCacheRefresher runs a background goroutine that proactively
+// refreshes the UAA access token at 75% of its lifetime, so that a scrape
+// is never the thing that blocks on a token exchange, and persists the
+// refresh token again whenever UAA rotates it. The goroutine exits as soon
+// as stop is closed (or never, if stop is nil), so a target evicted from
+// directorCache does not leak it.
+func startTokenCacheRefresher(target TargetConfig, origToken uaa.AccessToken, tokenFunc func(bool) (string, error), stop <-chan struct{}) {
+	const defaultRefreshInterval = 30 * time.Minute
+
+	go func() {
+		for {
+			token, err := tokenFunc(false)
+			if err != nil {
+				log.Errorf("Error fetching UAA access token for target `%s`: %s", target.Name, err.Error())
+				if sleepOrStop(defaultRefreshInterval, stop) {
+					return
+				}
+				continue
+			}
+
+			lifetime, err := accessTokenLifetime(token)
+			if err != nil || lifetime <= 0 {
+				lifetime = defaultRefreshInterval
+			}
+
+			if sleepOrStop(lifetime*3/4, stop) {
+				return
+			}
+
+			if _, err := tokenFunc(true); err != nil {
+				log.Errorf("Error refreshing UAA access token for target `%s`: %s", target.Name, err.Error())
+				continue
+			}
+
+			refreshToken := origToken.RefreshToken().Value()
+			if err := saveCachedRefreshToken(target.BoshUAATokenCacheFile, target.BoshUAATokenCacheKey, refreshToken); err != nil {
+				log.Errorf("Error persisting rotated UAA refresh token for target `%s`: %s", target.Name, err.Error())
+			}
+		}
+	}()
+}
+
+// sleepOrStop sleeps for d, returning early with true if stop is closed
+// first.
+func sleepOrStop(d time.Duration, stop <-chan struct{}) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return false
+	case <-stop:
+		return true
+	}
+}
+
+// probeHandler returns the `/probe?target=<name>` handler. Each request
+// resolves target from cfg, builds (or reuses from cache) the matching
+// director.Director, and runs a fresh collectors.NewBoshCollector against a
+// per-request prometheus.Registry so that targets never share metric state.
+func probeHandler(cfg *Config, cache *directorCache, writers *sdWriterCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		targetName := r.URL.Query().Get("target")
+		if targetName == "" {
+			http.Error(w, "'target' parameter must be specified", http.StatusBadRequest)
+			return
+		}
+
+		target, ok := cfg.Target(targetName)
+		if !ok {
+			http.Error(w, fmt.Sprintf("Unknown target `%s`", targetName), http.StatusNotFound)
+			return
+		}
+
+		boshClient, err := cache.Get(target)
+		if err != nil {
+			log.Errorf("Error creating BOSH Client for target `%s`: %s", targetName, err.Error())
+			http.Error(w, "Error creating BOSH Client", http.StatusInternalServerError)
+			return
+		}
+
+		boshInfo, err := boshClient.Info()
+		if err != nil {
+			log.Errorf("Error reading BOSH Info for target `%s`: %s", targetName, err.Error())
+			http.Error(w, "Error reading BOSH Info", http.StatusInternalServerError)
+			return
+		}
+
+		var deploymentsFilters []string
+		if target.FilterDeployments != "" {
+			deploymentsFilters = strings.Split(target.FilterDeployments, ",")
+		}
+		deploymentsFilter := filters.NewDeploymentsFilter(deploymentsFilters, boshClient)
+		deploymentsFetcher := deployments.NewFetcher(*deploymentsFilter)
+
+		var azsFilters []string
+		if target.FilterAZs != "" {
+			azsFilters = strings.Split(target.FilterAZs, ",")
+		}
+		azsFilter := filters.NewAZsFilter(azsFilters)
+
+		var collectorsFilters []string
+		if target.FilterCollectors != "" {
+			collectorsFilters = strings.Split(target.FilterCollectors, ",")
+		}
+		collectorsFilter, err := filters.NewCollectorsFilter(collectorsFilters)
+		if err != nil {
+			log.Errorf("Error processing Collectors Filter for target `%s`: %s", targetName, err.Error())
+			http.Error(w, "Error processing Collectors Filter", http.StatusInternalServerError)
+			return
+		}
+
+		var processesFilters []string
+		if target.SDProcessesRegexp != "" {
+			processesFilters = []string{target.SDProcessesRegexp}
+		}
+		processesFilter, err := filters.NewRegexpFilter(processesFilters)
+		if err != nil {
+			log.Errorf("Error processing Processes Regexp for target `%s`: %s", targetName, err.Error())
+			http.Error(w, "Error processing Processes Regexp", http.StatusInternalServerError)
+			return
+		}
+
+		sdWriters, err := writers.Get(target)
+		if err != nil {
+			log.Errorf("Error creating Service Discovery outputs for target `%s`: %s", targetName, err.Error())
+			http.Error(w, "Error creating Service Discovery outputs", http.StatusInternalServerError)
+			return
+		}
+
+		metricsEnvironment := target.MetricsEnvironment
+		if metricsEnvironment == "" {
+			metricsEnvironment = target.Name
+		}
+
+		boshCollector := collectors.NewBoshCollector(
+			*metricsNamespace,
+			metricsEnvironment,
+			boshInfo.Name,
+			boshInfo.UUID,
+			sdWriters,
+			deploymentsFetcher,
+			collectorsFilter,
+			azsFilter,
+			processesFilter,
+		)
+
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(boshCollector)
+		promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	lru "github.com/hashicorp/golang-lru"
+	"golang.org/x/sync/singleflight"
+
+	"github.com/bosh-prometheus/bosh_exporter/serviceDiscovery"
+)
+
+// defaultSDOutputs is used whenever --sd.output / sd_outputs is left empty,
+// preserving the exporter's original file_sd-only behavior.
+var defaultSDOutputs = []string{"file:bosh_target_groups.json"}
+
+// mountSDHTTPWriters registers "/sd" for every writer among sdWriters that
+// serves its target groups over HTTP.
+func mountSDHTTPWriters(sdWriters []serviceDiscovery.Writer) {
+	for _, writer := range sdWriters {
+		if httpWriter, ok := writer.(*serviceDiscovery.HTTPWriter); ok {
+			http.Handle("/sd", withBasicAuth(httpWriter.Handler().ServeHTTP))
+		}
+	}
+}
+
+// sdWriterCache caches the Service Discovery writers built for each target
+// in config-file mode, one per distinct target, so that stateful writers
+// (HTTPWriter's last-written target groups, a Consul/Kubernetes writer's
+// registrations) survive across scrapes instead of being rebuilt from
+// scratch on every `/probe` request. build deduplicates concurrent
+// first-time builds for the same target so that two simultaneous `/probe`
+// requests cannot each register their own Consul/Kubernetes writer.
+type sdWriterCache struct {
+	cache *lru.Cache
+	build singleflight.Group
+}
+
+func newSDWriterCache() (*sdWriterCache, error) {
+	cache, err := lru.New(directorCacheSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sdWriterCache{cache: cache}, nil
+}
+
+func (c *sdWriterCache) Get(target TargetConfig) ([]serviceDiscovery.Writer, error) {
+	if cached, ok := c.cache.Get(target.Name); ok {
+		return cached.([]serviceDiscovery.Writer), nil
+	}
+
+	writers, err, _ := c.build.Do(target.Name, func() (interface{}, error) {
+		if cached, ok := c.cache.Get(target.Name); ok {
+			return cached.([]serviceDiscovery.Writer), nil
+		}
+
+		outputs := target.SDOutputs
+		if len(outputs) == 0 {
+			outputs = []string{fmt.Sprintf("file:bosh_target_groups_%s.json", target.Name)}
+		}
+
+		writers, err := serviceDiscovery.ParseOutputs(outputs, target.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		c.cache.Add(target.Name, writers)
+
+		return writers, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return writers.([]serviceDiscovery.Writer), nil
+}
+
+// All returns every Writer built for every target currently in the cache,
+// so that the exporter can close them all on shutdown.
+func (c *sdWriterCache) All() []serviceDiscovery.Writer {
+	var all []serviceDiscovery.Writer
+
+	for _, key := range c.cache.Keys() {
+		if cached, ok := c.cache.Peek(key); ok {
+			all = append(all, cached.([]serviceDiscovery.Writer)...)
+		}
+	}
+
+	return all
+}
+
+// sdHandler returns the `/sd?target=<name>` handler serving the target
+// groups held by the named target's HTTPWriter, i.e. those of its most
+// recent `/probe` scrape.
+func sdHandler(cfg *Config, writers *sdWriterCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		targetName := r.URL.Query().Get("target")
+		if targetName == "" {
+			http.Error(w, "'target' parameter must be specified", http.StatusBadRequest)
+			return
+		}
+
+		target, ok := cfg.Target(targetName)
+		if !ok {
+			http.Error(w, fmt.Sprintf("Unknown target `%s`", targetName), http.StatusNotFound)
+			return
+		}
+
+		sdWriters, err := writers.Get(target)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error building Service Discovery outputs: %s", err.Error()), http.StatusInternalServerError)
+			return
+		}
+
+		for _, writer := range sdWriters {
+			if httpWriter, ok := writer.(*serviceDiscovery.HTTPWriter); ok {
+				httpWriter.Handler().ServeHTTP(w, r)
+				return
+			}
+		}
+
+		http.Error(w, fmt.Sprintf("Target `%s` does not have an `http` Service Discovery output configured", targetName), http.StatusNotFound)
+	}
+}
@@ -0,0 +1,80 @@
+package serviceDiscovery
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ParseOutput builds a Writer from one `--sd.output` flag value:
+//
+//	file:<path>.json          Prometheus file_sd JSON (the exporter's default)
+//	file:<path>.yaml          Prometheus file_sd YAML
+//	http                      serve target groups from /sd
+//	consul://<address>        register each target as a Consul service
+//	k8s://<namespace>/<name>  publish a Kubernetes EndpointSlice
+//
+// serviceName names the Consul output's services so that, in
+// multi-director mode, one target's registrations can be told apart from
+// another's. The Kubernetes output does not use it: its EndpointSlices are
+// named from <name> alone.
+func ParseOutput(raw string, serviceName string) (Writer, error) {
+	switch {
+	case raw == "http":
+		return NewHTTPWriter(), nil
+
+	case strings.HasPrefix(raw, "file:"):
+		path := strings.TrimPrefix(raw, "file:")
+		if strings.HasSuffix(path, ".yaml") || strings.HasSuffix(path, ".yml") {
+			return NewFileYAMLWriter(path), nil
+		}
+		return NewFileJSONWriter(path), nil
+
+	case strings.HasPrefix(raw, "consul://"):
+		return NewConsulWriter(strings.TrimPrefix(raw, "consul://"), serviceName)
+
+	case strings.HasPrefix(raw, "k8s://"):
+		parts := strings.SplitN(strings.TrimPrefix(raw, "k8s://"), "/", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("k8s Service Discovery output must be `k8s://<namespace>/<name>`, got `%s`", raw)
+		}
+		return NewKubernetesEndpointSliceWriter(parts[0], parts[1])
+
+	default:
+		return nil, fmt.Errorf("unknown Service Discovery output `%s`", raw)
+	}
+}
+
+// ParseOutputs builds a Writer for every raw --sd.output value.
+func ParseOutputs(raws []string, serviceName string) ([]Writer, error) {
+	writers := make([]Writer, 0, len(raws))
+
+	for _, raw := range raws {
+		writer, err := ParseOutput(raw, serviceName)
+		if err != nil {
+			return nil, err
+		}
+		writers = append(writers, writer)
+	}
+
+	return writers, nil
+}
+
+// CloseAll closes every Writer that implements Closer, continuing past the
+// first error so that one writer's shutdown failure does not prevent the
+// others from being torn down.
+func CloseAll(writers []Writer) error {
+	var firstErr error
+
+	for _, writer := range writers {
+		closer, ok := writer.(Closer)
+		if !ok {
+			continue
+		}
+
+		if err := closer.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
@@ -0,0 +1,134 @@
+package serviceDiscovery
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+// ConsulWriter registers each BOSH process as a Consul service, tagged
+// with its deployment/job/AZ labels, and keeps the catalog in sync as
+// target groups come and go between scrapes. mu guards registered, since
+// the same writer is reused across concurrent `/probe` scrapes of one
+// target.
+type ConsulWriter struct {
+	client      *consul.Client
+	serviceName string
+
+	mu         sync.Mutex
+	registered []string
+}
+
+// NewConsulWriter returns a Writer that registers services against the
+// Consul agent at address (empty uses the client library's default of
+// $CONSUL_HTTP_ADDR or 127.0.0.1:8500).
+func NewConsulWriter(address string, serviceName string) (*ConsulWriter, error) {
+	config := consul.DefaultConfig()
+	if address != "" {
+		config.Address = address
+	}
+
+	client, err := consul.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ConsulWriter{client: client, serviceName: serviceName}, nil
+}
+
+func (w *ConsulWriter) Write(targetGroups []TargetGroup) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	registered := make([]string, 0, len(targetGroups))
+
+	for _, group := range targetGroups {
+		for _, target := range group.Targets {
+			host, portStr, err := net.SplitHostPort(target)
+			if err != nil {
+				return err
+			}
+
+			port, err := strconv.Atoi(portStr)
+			if err != nil {
+				return err
+			}
+
+			id := fmt.Sprintf("%s-%s", w.serviceName, target)
+
+			registration := &consul.AgentServiceRegistration{
+				ID:      id,
+				Name:    w.serviceName,
+				Address: host,
+				Port:    port,
+				Tags:    consulTags(group.Labels),
+			}
+
+			if err := w.client.Agent().ServiceRegister(registration); err != nil {
+				return err
+			}
+
+			registered = append(registered, id)
+		}
+	}
+
+	if err := w.deregisterStale(registered); err != nil {
+		return err
+	}
+
+	w.registered = registered
+
+	return nil
+}
+
+// deregisterStale removes any service this writer previously registered
+// that is no longer present in the latest set of target groups. Callers
+// must hold w.mu.
+func (w *ConsulWriter) deregisterStale(registered []string) error {
+	stillRegistered := make(map[string]bool, len(registered))
+	for _, id := range registered {
+		stillRegistered[id] = true
+	}
+
+	for _, id := range w.registered {
+		if !stillRegistered[id] {
+			if err := w.client.Agent().ServiceDeregister(id); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Close deregisters every service this writer has registered, so a clean
+// exporter shutdown does not leave stale Consul catalog entries behind.
+func (w *ConsulWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, id := range w.registered {
+		if err := w.client.Agent().ServiceDeregister(id); err != nil {
+			return err
+		}
+	}
+
+	w.registered = nil
+
+	return nil
+}
+
+func consulTags(labels map[string]string) []string {
+	tags := make([]string, 0, len(labels))
+	for key, value := range labels {
+		if value == "" {
+			continue
+		}
+		tags = append(tags, fmt.Sprintf("%s=%s", key, value))
+	}
+
+	return tags
+}
@@ -0,0 +1,51 @@
+package serviceDiscovery
+
+import (
+	"encoding/json"
+	"io/ioutil"
+
+	"gopkg.in/yaml.v2"
+)
+
+// FileJSONWriter writes target groups to filename as Prometheus `file_sd`
+// JSON, the exporter's original (and still default) Service Discovery
+// output.
+type FileJSONWriter struct {
+	filename string
+}
+
+// NewFileJSONWriter returns a Writer that (re)writes filename on every
+// Write call.
+func NewFileJSONWriter(filename string) *FileJSONWriter {
+	return &FileJSONWriter{filename: filename}
+}
+
+func (w *FileJSONWriter) Write(targetGroups []TargetGroup) error {
+	content, err := json.Marshal(targetGroups)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(w.filename, content, 0644)
+}
+
+// FileYAMLWriter writes target groups to filename as Prometheus `file_sd`
+// YAML.
+type FileYAMLWriter struct {
+	filename string
+}
+
+// NewFileYAMLWriter returns a Writer that (re)writes filename on every
+// Write call.
+func NewFileYAMLWriter(filename string) *FileYAMLWriter {
+	return &FileYAMLWriter{filename: filename}
+}
+
+func (w *FileYAMLWriter) Write(targetGroups []TargetGroup) error {
+	content, err := yaml.Marshal(targetGroups)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(w.filename, content, 0644)
+}
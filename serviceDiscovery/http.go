@@ -0,0 +1,50 @@
+package serviceDiscovery
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+// HTTPWriter keeps the most recently written target groups in memory and
+// serves them back as JSON, so that Prometheus's `http_sd_configs` can pull
+// Service Discovery data directly without a shared filesystem between the
+// exporter and the Prometheus server.
+type HTTPWriter struct {
+	mu           sync.RWMutex
+	targetGroups []TargetGroup
+}
+
+// NewHTTPWriter returns an empty HTTPWriter. Register its Handler on
+// whatever path the exporter exposes (by convention, "/sd").
+func NewHTTPWriter() *HTTPWriter {
+	return &HTTPWriter{}
+}
+
+func (w *HTTPWriter) Write(targetGroups []TargetGroup) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.targetGroups = targetGroups
+
+	return nil
+}
+
+// Handler returns the `/sd` http.Handler serving the last written target
+// groups as JSON.
+func (w *HTTPWriter) Handler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		w.mu.RLock()
+		targetGroups := w.targetGroups
+		w.mu.RUnlock()
+
+		if targetGroups == nil {
+			targetGroups = []TargetGroup{}
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(rw).Encode(targetGroups); err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
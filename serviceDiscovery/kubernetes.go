@@ -0,0 +1,178 @@
+package serviceDiscovery
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	discoveryclient "k8s.io/client-go/kubernetes/typed/discovery/v1"
+	"k8s.io/client-go/rest"
+)
+
+// KubernetesEndpointSliceWriter publishes target groups as Kubernetes
+// EndpointSlices, so that an in-cluster Prometheus using
+// kubernetes_sd_configs discovers BOSH processes the same way it discovers
+// any other endpoint. EndpointSlice.Ports applies to every address in the
+// slice, so one slice per distinct port is published rather than one
+// shared slice, so that Prometheus does not scrape the address x port
+// cross product of every BOSH job sharing this writer.
+// mu guards published, since the same writer is reused across concurrent
+// `/probe` scrapes of one target.
+type KubernetesEndpointSliceWriter struct {
+	client    kubernetes.Interface
+	namespace string
+	name      string
+
+	mu        sync.Mutex
+	published []string
+}
+
+// NewKubernetesEndpointSliceWriter returns a Writer that publishes to
+// EndpointSlices named "<name>-<port>" in namespace, authenticating via the
+// in-cluster service account.
+func NewKubernetesEndpointSliceWriter(namespace string, name string) (*KubernetesEndpointSliceWriter, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &KubernetesEndpointSliceWriter{client: client, namespace: namespace, name: name}, nil
+}
+
+func (w *KubernetesEndpointSliceWriter) Write(targetGroups []TargetGroup) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	client := w.client.DiscoveryV1().EndpointSlices(w.namespace)
+	ctx := context.Background()
+
+	published := make([]string, 0, len(w.published))
+
+	for port, endpoints := range kubernetesEndpointsByPort(targetGroups) {
+		sliceName := fmt.Sprintf("%s-%d", w.name, port)
+		protocol := corev1.ProtocolTCP
+		port32 := port
+
+		slice := &discoveryv1.EndpointSlice{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      sliceName,
+				Namespace: w.namespace,
+				Labels: map[string]string{
+					"kubernetes.io/service-name": w.name,
+				},
+			},
+			AddressType: discoveryv1.AddressTypeIPv4,
+			Ports: []discoveryv1.EndpointPort{
+				{
+					Name:     &w.name,
+					Port:     &port32,
+					Protocol: &protocol,
+				},
+			},
+			Endpoints: endpoints,
+		}
+
+		existing, err := client.Get(ctx, sliceName, metav1.GetOptions{})
+		if err == nil {
+			slice.ResourceVersion = existing.ResourceVersion
+			_, err = client.Update(ctx, slice, metav1.UpdateOptions{})
+		} else if apierrors.IsNotFound(err) {
+			_, err = client.Create(ctx, slice, metav1.CreateOptions{})
+		}
+		if err != nil {
+			return err
+		}
+
+		published = append(published, sliceName)
+	}
+
+	if err := w.deregisterStale(client, ctx, published); err != nil {
+		return err
+	}
+
+	w.published = published
+
+	return nil
+}
+
+// deregisterStale deletes any EndpointSlice this writer previously
+// published that is no longer present in the latest set of target groups,
+// e.g. because a port stopped being exposed. Callers must hold w.mu.
+func (w *KubernetesEndpointSliceWriter) deregisterStale(client discoveryclient.EndpointSliceInterface, ctx context.Context, published []string) error {
+	stillPublished := make(map[string]bool, len(published))
+	for _, name := range published {
+		stillPublished[name] = true
+	}
+
+	for _, name := range w.published {
+		if stillPublished[name] {
+			continue
+		}
+		if err := client.Delete(ctx, name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close deletes every EndpointSlice this writer has published, so a clean
+// exporter shutdown does not leave stale entries behind.
+func (w *KubernetesEndpointSliceWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	client := w.client.DiscoveryV1().EndpointSlices(w.namespace)
+
+	for _, name := range w.published {
+		if err := client.Delete(context.Background(), name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	w.published = nil
+
+	return nil
+}
+
+// kubernetesEndpointsByPort groups every target's address by the port it
+// serves, so each port can be published as its own correctly-scoped
+// EndpointSlice.
+func kubernetesEndpointsByPort(targetGroups []TargetGroup) map[int32][]discoveryv1.Endpoint {
+	endpointsByPort := map[int32][]discoveryv1.Endpoint{}
+
+	for _, group := range targetGroups {
+		for _, target := range group.Targets {
+			host, portStr, err := net.SplitHostPort(target)
+			if err != nil {
+				continue
+			}
+
+			port, err := strconv.Atoi(portStr)
+			if err != nil {
+				continue
+			}
+
+			port32 := int32(port)
+			ready := true
+			endpointsByPort[port32] = append(endpointsByPort[port32], discoveryv1.Endpoint{
+				Addresses:  []string{host},
+				Conditions: discoveryv1.EndpointConditions{Ready: &ready},
+			})
+		}
+	}
+
+	return endpointsByPort
+}
@@ -0,0 +1,22 @@
+package serviceDiscovery
+
+// TargetGroup is a single Prometheus `file_sd`/`http_sd` target group: a set
+// of scrape targets sharing the same labels.
+type TargetGroup struct {
+	Targets []string          `json:"targets" yaml:"targets"`
+	Labels  map[string]string `json:"labels" yaml:"labels"`
+}
+
+// Writer publishes a set of TargetGroups to a Service Discovery backend.
+// collectors.NewBoshCollector fans each scrape's target groups out to every
+// configured Writer.
+type Writer interface {
+	Write(targetGroups []TargetGroup) error
+}
+
+// Closer is implemented by Writers that hold a registration open with an
+// external system (e.g. a Consul catalog entry) and need to tear it down
+// when the exporter shuts down.
+type Closer interface {
+	Close() error
+}
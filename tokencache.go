@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// tokenCacheSaltSize is the size, in bytes, of the random per-file salt
+// scrypt uses to derive the AES-GCM key from --bosh.uaa.token-cache-key.
+const tokenCacheSaltSize = 16
+
+// scrypt cost parameters for deriving the token cache key. N=32768 is the
+// interactive-login-strength setting recommended by the scrypt package.
+const (
+	tokenCacheScryptN = 32768
+	tokenCacheScryptR = 8
+	tokenCacheScryptP = 1
+	tokenCacheKeySize = 32
+)
+
+// tokenCacheEntry is the JSON payload encrypted at rest in a
+// --bosh.uaa.token-cache-file.
+type tokenCacheEntry struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// loadCachedRefreshToken returns the refresh token persisted at path, or ""
+// if the file does not exist yet.
+func loadCachedRefreshToken(path string, passphrase string) (string, error) {
+	ciphertext, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+
+	plaintext, err := decryptTokenCache(ciphertext, passphrase)
+	if err != nil {
+		return "", err
+	}
+
+	var entry tokenCacheEntry
+	if err := json.Unmarshal(plaintext, &entry); err != nil {
+		return "", err
+	}
+
+	return entry.RefreshToken, nil
+}
+
+// saveCachedRefreshToken persists refreshToken to path, mode 0600.
+func saveCachedRefreshToken(path string, passphrase string, refreshToken string) error {
+	plaintext, err := json.Marshal(tokenCacheEntry{RefreshToken: refreshToken})
+	if err != nil {
+		return err
+	}
+
+	ciphertext, err := encryptTokenCache(plaintext, passphrase)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, ciphertext, 0600)
+}
+
+// newTokenCacheAEAD derives the AES-GCM key for passphrase via scrypt,
+// salted with salt, so that a weak/short --bosh.uaa.token-cache-key cannot
+// be brute-forced offline from a stolen cache file as cheaply as a bare
+// hash would allow.
+func newTokenCacheAEAD(passphrase string, salt []byte) (cipher.AEAD, error) {
+	if passphrase == "" {
+		return nil, errors.New("a --bosh.uaa.token-cache-key (or $BOSH_EXPORTER_UAA_TOKEN_CACHE_KEY) is required to use --bosh.uaa.token-cache-file")
+	}
+
+	key, err := scrypt.Key([]byte(passphrase), salt, tokenCacheScryptN, tokenCacheScryptR, tokenCacheScryptP, tokenCacheKeySize)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func encryptTokenCache(plaintext []byte, passphrase string) ([]byte, error) {
+	salt := make([]byte, tokenCacheSaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+
+	gcm, err := newTokenCacheAEAD(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	ciphertext := gcm.Seal(nonce, nonce, plaintext, nil)
+
+	return append(salt, ciphertext...), nil
+}
+
+func decryptTokenCache(ciphertext []byte, passphrase string) ([]byte, error) {
+	if len(ciphertext) < tokenCacheSaltSize {
+		return nil, errors.New("token cache file is corrupt")
+	}
+	salt, ciphertext := ciphertext[:tokenCacheSaltSize], ciphertext[tokenCacheSaltSize:]
+
+	gcm, err := newTokenCacheAEAD(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, errors.New("token cache file is corrupt")
+	}
+
+	nonce, data := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+
+	return gcm.Open(nil, nonce, data, nil)
+}
+
+// accessTokenLifetime returns the total lifetime of a JWT access token
+// ("exp" minus "iat", not the time left until "exp"), derived from its
+// unverified claims. It is used only to pace
+// the proactive background refresh, never to make a trust decision.
+func accessTokenLifetime(token string) (time.Duration, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return 0, errors.New("UAA access token is not a JWT")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return 0, err
+	}
+
+	var claims struct {
+		IssuedAt  int64 `json:"iat"`
+		ExpiresAt int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return 0, err
+	}
+
+	if claims.IssuedAt == 0 || claims.ExpiresAt <= claims.IssuedAt {
+		return 0, errors.New("UAA access token is missing iat/exp claims")
+	}
+
+	return time.Duration(claims.ExpiresAt-claims.IssuedAt) * time.Second, nil
+}